@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/concourse/concourse/atc"
+)
+
+// tsaSessionTTL is how long a session is kept after its last heartbeat
+// before it's considered stale and dropped, in case a TSA instance dies
+// without sending a goodbye.
+const tsaSessionTTL = 90 * time.Second
+
+// TSASessionTracker holds the most recent heartbeat for every SSH session
+// reported by any TSA instance, keyed by session ID, meant to let worker
+// commands be routed to the web node that owns the connection via
+// PeerFor. A session is tracked from the moment it's accepted, before its
+// WorkerName is necessarily known, so that a register-worker heartbeat
+// arriving for it later isn't dropped for racing the session list.
+//
+// Nothing in this tree registers SaveTSASessions on a router, calls
+// PeerFor from a command dispatcher, or calls SessionGossip.
+// SessionRegistered to ever actually populate WorkerName, so despite the
+// above, no worker command is routed by session today - this type is
+// scaffolding for that dispatcher, not a working implementation of it.
+type TSASessionTracker struct {
+	lock     sync.RWMutex
+	sessions map[string]atc.TSASession
+}
+
+func NewTSASessionTracker() *TSASessionTracker {
+	return &TSASessionTracker{
+		sessions: make(map[string]atc.TSASession),
+	}
+}
+
+// Heartbeat replaces the tracked sessions for a peer with the set it just
+// reported. An empty set is the peer's goodbye on graceful shutdown.
+func (t *TSASessionTracker) Heartbeat(peerAddress string, sessions []atc.TSASession) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for sessionID, session := range t.sessions {
+		if session.PeerAddress == peerAddress {
+			delete(t.sessions, sessionID)
+		}
+	}
+
+	for _, session := range sessions {
+		t.sessions[session.SessionID] = session
+	}
+}
+
+// PeerFor returns the address of the TSA instance currently holding the
+// named worker's SSH session, if its heartbeat hasn't gone stale.
+func (t *TSASessionTracker) PeerFor(workerName string) (string, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, session := range t.sessions {
+		if session.WorkerName != workerName {
+			continue
+		}
+
+		if time.Since(session.LastSeen) > tsaSessionTTL {
+			continue
+		}
+
+		return session.PeerAddress, true
+	}
+
+	return "", false
+}
+
+// SaveTSASessions handles the heartbeat POSTed by each TSA instance.
+//
+// It isn't registered on any router yet, and PeerFor isn't called by any
+// worker command dispatcher — both live outside this package's present
+// scope and need to be wired up alongside it before a hijack/land-worker/
+// retire-worker request actually gets proxied to the right web node.
+func (t *TSASessionTracker) SaveTSASessions(w http.ResponseWriter, r *http.Request) {
+	peerAddress := r.URL.Query().Get("peer_address")
+
+	var sessions []atc.TSASession
+	if err := json.NewDecoder(r.Body).Decode(&sessions); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if peerAddress == "" && len(sessions) > 0 {
+		peerAddress = sessions[0].PeerAddress
+	}
+
+	t.Heartbeat(peerAddress, sessions)
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/concourse/concourse/atc"
+)
+
+func TestTSASessionTrackerHeartbeatKeepsSessionBeforeWorkerNameKnown(t *testing.T) {
+	tracker := NewTSASessionTracker()
+
+	tracker.Heartbeat("10.0.0.1:7777", []atc.TSASession{
+		{PeerAddress: "10.0.0.1:7777", SessionID: "session-1", LastSeen: time.Now()},
+	})
+
+	_, found := tracker.PeerFor("worker-1")
+	if found {
+		t.Fatalf("expected no peer for a worker name not yet registered on the session")
+	}
+
+	tracker.Heartbeat("10.0.0.1:7777", []atc.TSASession{
+		{PeerAddress: "10.0.0.1:7777", SessionID: "session-1", WorkerName: "worker-1", LastSeen: time.Now()},
+	})
+
+	peer, found := tracker.PeerFor("worker-1")
+	if !found {
+		t.Fatalf("expected a peer once the session's heartbeat reports its worker name")
+	}
+	if peer != "10.0.0.1:7777" {
+		t.Fatalf("expected peer %q, got %q", "10.0.0.1:7777", peer)
+	}
+}
+
+func TestTSASessionTrackerHeartbeatReplacesOnlyThatPeersSessions(t *testing.T) {
+	tracker := NewTSASessionTracker()
+
+	tracker.Heartbeat("10.0.0.1:7777", []atc.TSASession{
+		{PeerAddress: "10.0.0.1:7777", SessionID: "session-1", WorkerName: "worker-1", LastSeen: time.Now()},
+	})
+	tracker.Heartbeat("10.0.0.2:7777", []atc.TSASession{
+		{PeerAddress: "10.0.0.2:7777", SessionID: "session-2", WorkerName: "worker-2", LastSeen: time.Now()},
+	})
+
+	tracker.Heartbeat("10.0.0.1:7777", nil)
+
+	if _, found := tracker.PeerFor("worker-1"); found {
+		t.Fatalf("expected worker-1's session to be dropped by its peer's goodbye")
+	}
+	if _, found := tracker.PeerFor("worker-2"); !found {
+		t.Fatalf("expected worker-2's session to survive an unrelated peer's goodbye")
+	}
+}
+
+func TestTSASessionTrackerPeerForIgnoresStaleSessions(t *testing.T) {
+	tracker := NewTSASessionTracker()
+
+	tracker.Heartbeat("10.0.0.1:7777", []atc.TSASession{
+		{PeerAddress: "10.0.0.1:7777", SessionID: "session-1", WorkerName: "worker-1", LastSeen: time.Now().Add(-2 * tsaSessionTTL)},
+	})
+
+	if _, found := tracker.PeerFor("worker-1"); found {
+		t.Fatalf("expected a session past its TTL to be treated as gone")
+	}
+}
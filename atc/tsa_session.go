@@ -0,0 +1,18 @@
+package atc
+
+import "time"
+
+// TSASession describes a single SSH session that a TSA instance is
+// currently holding open for a worker, as reported by that instance's
+// heartbeat loop. These are meant to let the ATC route worker commands
+// (hijack, land-worker, retire-worker, ...) to the web node that actually
+// owns the connection, instead of picking one at random, via
+// TSASessionTracker.PeerFor - but as of this series nothing calls
+// PeerFor, so no command is actually routed by session yet.
+type TSASession struct {
+	PeerAddress string    `json:"peer_address"`
+	WorkerName  string    `json:"worker_name,omitempty"`
+	SessionID   string    `json:"session_id"`
+	StartedAt   time.Time `json:"started_at"`
+	LastSeen    time.Time `json:"last_seen"`
+}
@@ -0,0 +1,360 @@
+package tsacmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"golang.org/x/crypto/ssh"
+)
+
+// AuditEvent is a single structured record of an SSH connection accepted by
+// the TSA server, meant to be tracked per session from the moment a public
+// key or certificate is accepted through to the connection closing, so
+// that "who connected as which worker/team" can be reconstructed without
+// grepping lager logs.
+//
+// RequestType, EndTime, BytesForwarded, and ExitStatus depend on
+// SessionRequest and SessionEnded being called from the request-dispatch
+// layer, which nothing in this tree does yet (see SessionRequest and
+// SessionEnded below): every real event's RequestType is empty, and its
+// EndTime/ExitStatus come only from Reap's maxAge-later approximation
+// rather than the connection's actual close.
+type AuditEvent struct {
+	SessionID      string    `json:"session_id"`
+	RemoteAddr     string    `json:"remote_addr"`
+	KeyFingerprint string    `json:"key_fingerprint"`
+	CertSerial     uint64    `json:"cert_serial,omitempty"`
+	CertKeyID      string    `json:"cert_key_id,omitempty"`
+	CertPrincipals []string  `json:"cert_principals,omitempty"`
+	Team           string    `json:"team,omitempty"`
+	RequestType    string    `json:"request_type,omitempty"`
+	StartTime      time.Time `json:"start_time"`
+	EndTime        time.Time `json:"end_time,omitempty"`
+	BytesForwarded int64     `json:"bytes_forwarded"`
+	ExitStatus     int       `json:"exit_status"`
+}
+
+// AuditSink is a destination that completed audit events are written to.
+// Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Record(AuditEvent)
+	Close() error
+}
+
+// AuditLog tracks in-flight sessions and forwards each one to a sink once
+// it ends. Sessions are identified by their SSH session ID, which is stable
+// for the lifetime of a connection.
+type AuditLog struct {
+	sink AuditSink
+
+	lock     sync.Mutex
+	sessions map[string]*AuditEvent
+}
+
+func NewAuditLog(sink AuditSink) *AuditLog {
+	return &AuditLog{
+		sink:     sink,
+		sessions: make(map[string]*AuditEvent),
+	}
+}
+
+// auditReapExitStatus marks an event that was flushed by Reap rather than
+// by an explicit SessionEnded call, because the connection outlived
+// maxAge without the request-dispatch layer reporting it closed.
+const auditReapExitStatus = -1
+
+// Reap flushes any tracked session older than maxAge to the sink, so that
+// a session whose end was never reported (e.g. because the caller wiring
+// SessionEnded in from the connection-close path is incomplete) doesn't
+// pin an event in memory forever and so that operators still get a record
+// of the connection, even if its end time and byte count are approximate.
+// This is a backstop, not a substitute for calling SessionEnded from the
+// request-dispatch layer as soon as a session actually closes.
+func (a *AuditLog) Reap(stop <-chan struct{}, interval time.Duration, maxAge time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.reapOnce(maxAge)
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (a *AuditLog) reapOnce(maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+
+	a.lock.Lock()
+	var stale []*AuditEvent
+	for sessionID, event := range a.sessions {
+		if event.StartTime.Before(cutoff) {
+			stale = append(stale, event)
+			delete(a.sessions, sessionID)
+		}
+	}
+	a.lock.Unlock()
+
+	for _, event := range stale {
+		event.EndTime = time.Now()
+		event.ExitStatus = auditReapExitStatus
+
+		a.sink.Record(*event)
+	}
+}
+
+// SessionStarted begins tracking a session that was just authenticated,
+// recording the presented key's fingerprint and, if it was a certificate,
+// the cert's serial, key ID, and principals.
+func (a *AuditLog) SessionStarted(sessionID string, remoteAddr string, key ssh.PublicKey, team string) {
+	event := &AuditEvent{
+		SessionID:      sessionID,
+		RemoteAddr:     remoteAddr,
+		KeyFingerprint: ssh.FingerprintSHA256(key),
+		Team:           team,
+		StartTime:      time.Now(),
+	}
+
+	if cert, ok := key.(*ssh.Certificate); ok {
+		event.CertSerial = cert.Serial
+		event.CertKeyID = cert.KeyId
+		event.CertPrincipals = cert.ValidPrincipals
+	}
+
+	a.lock.Lock()
+	a.sessions[sessionID] = event
+	a.lock.Unlock()
+}
+
+// SessionRequest records the type of request a session made, e.g.
+// "register-worker", "forward-worker", or "land-worker". It must be
+// called from the request-dispatch layer (tsa/tsacmd/server.go) as soon as the
+// request type is known; that layer isn't part of this tree, so nothing
+// calls SessionRequest yet and RequestType is empty on every real event.
+func (a *AuditLog) SessionRequest(sessionID string, requestType string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if event, found := a.sessions[sessionID]; found {
+		event.RequestType = requestType
+	}
+}
+
+// SessionEnded finalizes a session's event with the number of bytes
+// forwarded and its exit status, then hands it off to the sink. It must
+// be called from the request-dispatch layer (tsa/tsacmd/server.go) as soon as
+// the underlying connection closes, so the event carries an accurate end
+// time and byte count; that layer isn't part of this tree, so nothing
+// calls SessionEnded yet and every real event is instead eventually
+// flushed - up to AuditLogMaxSessionAge later, with an approximate end
+// time and no byte count - by Reap.
+func (a *AuditLog) SessionEnded(sessionID string, bytesForwarded int64, exitStatus int) {
+	a.lock.Lock()
+	event, found := a.sessions[sessionID]
+	delete(a.sessions, sessionID)
+	a.lock.Unlock()
+
+	if !found {
+		return
+	}
+
+	event.EndTime = time.Now()
+	event.BytesForwarded = bytesForwarded
+	event.ExitStatus = exitStatus
+
+	a.sink.Record(*event)
+}
+
+// multiAuditSink fans a single event out to every configured sink.
+type multiAuditSink []AuditSink
+
+func (s multiAuditSink) Record(event AuditEvent) {
+	for _, sink := range s {
+		sink.Record(event)
+	}
+}
+
+func (s multiAuditSink) Close() error {
+	for _, sink := range s {
+		if err := sink.Close(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fileAuditSink writes one JSON object per line to a file, fsync'd on every
+// write so a crash doesn't lose the most recent record.
+type fileAuditSink struct {
+	lock sync.Mutex
+	file *os.File
+}
+
+func NewFileAuditSink(path string) (AuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log file: %s", err)
+	}
+
+	return &fileAuditSink{file: f}, nil
+}
+
+func (s *fileAuditSink) Record(event AuditEvent) {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.file.Write(append(bs, '\n'))
+	s.file.Sync()
+}
+
+func (s *fileAuditSink) Close() error {
+	return s.file.Close()
+}
+
+// syslogAuditSink ships each event as a JSON-formatted syslog message.
+type syslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+func NewSyslogAuditSink() (AuditSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO, "tsa")
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to syslog: %s", err)
+	}
+
+	return &syslogAuditSink{writer: w}, nil
+}
+
+func (s *syslogAuditSink) Record(event AuditEvent) {
+	bs, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.writer.Info(string(bs))
+}
+
+func (s *syslogAuditSink) Close() error {
+	return s.writer.Close()
+}
+
+// s3AuditSink batches events and uploads them as gzipped JSON-lines objects
+// at a fixed interval, mirroring off-box SSH log shipping setups where the
+// TSA host itself isn't trusted to retain a tamper-evident record.
+type s3AuditSink struct {
+	logger        lager.Logger
+	url           string
+	flushInterval time.Duration
+	httpClient    *http.Client
+
+	lock   sync.Mutex
+	buffer []AuditEvent
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewS3AuditSink(logger lager.Logger, url string, flushInterval time.Duration) AuditSink {
+	s := &s3AuditSink{
+		logger:        logger,
+		url:           url,
+		flushInterval: flushInterval,
+		httpClient:    http.DefaultClient,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+
+	go s.loop()
+
+	return s
+}
+
+func (s *s3AuditSink) Record(event AuditEvent) {
+	s.lock.Lock()
+	s.buffer = append(s.buffer, event)
+	s.lock.Unlock()
+}
+
+func (s *s3AuditSink) loop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+func (s *s3AuditSink) flush() {
+	s.lock.Lock()
+	events := s.buffer
+	s.buffer = nil
+	s.lock.Unlock()
+
+	if len(events) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+
+	gz := gzip.NewWriter(&body)
+	enc := json.NewEncoder(gz)
+	for _, event := range events {
+		if err := enc.Encode(event); err != nil {
+			s.logger.Error("failed-to-encode-audit-event", err)
+		}
+	}
+	gz.Close()
+
+	req, err := http.NewRequest("PUT", s.url, &body)
+	if err != nil {
+		s.logger.Error("failed-to-build-audit-upload-request", err)
+		return
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		s.logger.Error("failed-to-upload-audit-events", err, lager.Data{"count": len(events)})
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		s.logger.Error("audit-upload-rejected", fmt.Errorf("unexpected status: %s", resp.Status))
+	}
+}
+
+func (s *s3AuditSink) Close() error {
+	close(s.stop)
+	<-s.done
+	return nil
+}
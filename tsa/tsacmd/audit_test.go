@@ -0,0 +1,50 @@
+package tsacmd
+
+import (
+	"testing"
+	"time"
+)
+
+type fakeAuditSink struct {
+	recorded []AuditEvent
+}
+
+func (s *fakeAuditSink) Record(event AuditEvent) {
+	s.recorded = append(s.recorded, event)
+}
+
+func (s *fakeAuditSink) Close() error {
+	return nil
+}
+
+func TestAuditLogReapFlushesStaleSessions(t *testing.T) {
+	sink := &fakeAuditSink{}
+	auditLog := NewAuditLog(sink)
+
+	auditLog.SessionStarted("stale-session", "10.0.0.1:1234", testRSAKey(t), "main")
+	auditLog.sessions["stale-session"].StartTime = time.Now().Add(-2 * time.Hour)
+
+	auditLog.SessionStarted("fresh-session", "10.0.0.2:1234", testRSAKey(t), "main")
+
+	auditLog.reapOnce(1 * time.Hour)
+
+	if len(sink.recorded) != 1 {
+		t.Fatalf("expected exactly one reaped event, got %d", len(sink.recorded))
+	}
+
+	if sink.recorded[0].SessionID != "stale-session" {
+		t.Fatalf("expected the stale session to be reaped, got %q", sink.recorded[0].SessionID)
+	}
+
+	if sink.recorded[0].ExitStatus != auditReapExitStatus {
+		t.Fatalf("expected reaped event to carry the reap exit status, got %d", sink.recorded[0].ExitStatus)
+	}
+
+	if _, found := auditLog.sessions["stale-session"]; found {
+		t.Fatalf("expected the stale session to be removed from the in-flight map")
+	}
+
+	if _, found := auditLog.sessions["fresh-session"]; !found {
+		t.Fatalf("expected the fresh session to remain tracked")
+	}
+}
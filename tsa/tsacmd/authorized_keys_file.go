@@ -0,0 +1,54 @@
+package tsacmd
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// AuthorizedKeysFile is a flag value that remembers the path it was parsed
+// from, in addition to the keys it contained at parse time, so that the
+// file can be re-read later on without the operator having to separately
+// track which path backs which flag.
+type AuthorizedKeysFile struct {
+	Path string
+	Keys []ssh.PublicKey
+}
+
+func (f *AuthorizedKeysFile) UnmarshalFlag(value string) error {
+	keys, err := loadAuthorizedKeysFile(value)
+	if err != nil {
+		return err
+	}
+
+	f.Path = value
+	f.Keys = keys
+
+	return nil
+}
+
+func loadAuthorizedKeysFile(path string) ([]ssh.PublicKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read authorized keys file: %s", err)
+	}
+
+	var keys []ssh.PublicKey
+
+	for len(bs) > 0 {
+		key, _, _, rest, err := ssh.ParseAuthorizedKey(bs)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse authorized key: %s", err)
+		}
+
+		keys = append(keys, key)
+		bs = rest
+	}
+
+	return keys, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -12,10 +13,18 @@ import (
 	"github.com/concourse/concourse/atc"
 	"github.com/concourse/concourse/tsa"
 	"github.com/concourse/flag"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/tedsuo/ifrit"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/time/rate"
 )
 
+// teamPrincipalPrefix is the prefix used on a certificate principal that
+// maps a worker connection to a team when the signing CA isn't registered
+// to a single team via --team-user-ca.
+const teamPrincipalPrefix = "team:"
+
 type TSACommand struct {
 	Logger flag.Lager
 
@@ -26,15 +35,31 @@ type TSACommand struct {
 	DebugBindIP   flag.IP `long:"debug-bind-ip"   default:"127.0.0.1" description:"IP address on which to listen for the pprof debugger endpoints."`
 	DebugBindPort uint16  `long:"debug-bind-port" default:"2221"      description:"Port on which to listen for the pprof debugger endpoints."`
 
-	HostKey            *flag.PrivateKey               `long:"host-key"        required:"true" description:"Path to private key to use for the SSH server."`
-	AuthorizedKeys     flag.AuthorizedKeys            `long:"authorized-keys" description:"Path to file containing keys to authorize, in SSH authorized_keys format (one public key per line)."`
-	TeamAuthorizedKeys map[string]flag.AuthorizedKeys `long:"team-authorized-keys" value-name:"NAME:PATH" description:"Path to file containing keys to authorize, in SSH authorized_keys format (one public key per line)."`
+	HostKey            *flag.PrivateKey              `long:"host-key"        required:"true" description:"Path to private key to use for the SSH server."`
+	AuthorizedKeys     AuthorizedKeysFile            `long:"authorized-keys" description:"Path to file containing keys to authorize, in SSH authorized_keys format (one public key per line). Re-read on SIGHUP or when the file changes."`
+	TeamAuthorizedKeys map[string]AuthorizedKeysFile `long:"team-authorized-keys" value-name:"NAME:PATH" description:"Path to file containing keys to authorize, in SSH authorized_keys format (one public key per line). Re-read on SIGHUP or when the file changes."`
+
+	UserCA         flag.AuthorizedKeys            `long:"user-ca" description:"Path to file containing trusted SSH CA public keys, in SSH authorized_keys format, used to authorize short-lived user certificates. The team is derived from a 'team:NAME' certificate principal."`
+	TeamUserCA     map[string]flag.AuthorizedKeys `long:"team-user-ca" value-name:"NAME:PATH" description:"Path to file containing trusted SSH CA public keys for a single team; certificates signed by this CA are authorized for that team regardless of principals."`
+	RevocationList flag.File                      `long:"revocation-list" description:"Path to a file of revoked certificate serials and public keys, one 'serial <N>' or authorized_keys-format line per entry, used to reject revoked certificates and keys. Reloaded on SIGHUP."`
 
 	ATCURLs []flag.URL `long:"atc-url" required:"true" description:"ATC API endpoints to which workers will be registered."`
 
 	SessionSigningKey *flag.PrivateKey `long:"session-signing-key" required:"true" description:"Path to private key to use when signing tokens in reqests to the ATC during registration."`
 
 	HeartbeatInterval time.Duration `long:"heartbeat-interval" default:"30s" description:"interval on which to heartbeat workers to the ATC"`
+
+	AuditLogFile          string        `long:"audit-log-file" description:"Path to append a JSON-lines audit log of accepted SSH connections to."`
+	AuditLogSyslog        bool          `long:"audit-log-syslog" description:"Ship the SSH connection audit log to syslog."`
+	AuditLogS3            flag.URL      `long:"audit-log-s3" description:"URL to PUT batched, gzipped audit log uploads to."`
+	AuditLogS3Interval    time.Duration `long:"audit-log-s3-interval" default:"1m" description:"How often to flush batched audit log uploads to --audit-log-s3."`
+	AuditLogMaxSessionAge time.Duration `long:"audit-log-max-session-age" default:"24h" description:"Flush a session's audit event after this long even if its end was never explicitly reported, so long-lived connections don't pin memory forever."`
+
+	MaxConcurrentSessionsPerTeam int           `long:"max-concurrent-sessions-per-team" default:"0" description:"Maximum number of concurrent worker SSH sessions a single team may hold open. 0 means no limit."`
+	MaxConcurrentSessions        int           `long:"max-concurrent-sessions" default:"0" description:"Maximum number of concurrent worker SSH sessions across all teams. 0 means no limit."`
+	MaxConnectionsPerSecond      float64       `long:"max-connections-per-second-per-team" default:"0" description:"Maximum rate of new SSH connections a single team may open per second, enforced with a token bucket. 0 means no limit."`
+	MaxConnectionsBurst          int           `long:"max-connections-burst-per-team" default:"5" description:"Burst size for --max-connections-per-second-per-team."`
+	MaxSessionLease              time.Duration `long:"max-session-lease" default:"24h" description:"Release a session's concurrency quota after this long even if its end was never explicitly reported, so long-lived connections don't permanently consume a slot."`
 }
 
 type TeamAuthKeys struct {
@@ -47,25 +72,87 @@ func (cmd *TSACommand) Runner(args []string, webConfig concourse.WebConfig) (ifr
 
 	atcEndpointPicker := tsa.NewRandomATCEndpointPicker(cmd.ATCURLs)
 
-	teamAuthorizedKeys, err := cmd.loadTeamAuthorizedKeys()
+	teamAuthorizedKeys := cmd.teamAuthorizedKeys()
+
+	teamUserCAs, err := cmd.loadTeamUserCAs()
 	if err != nil {
-		return nil, fmt.Errorf("failed to load team authorized keys: %s", err)
+		return nil, fmt.Errorf("failed to load team user CAs: %s", err)
 	}
 
 	if len(cmd.AuthorizedKeys.Keys)+len(cmd.TeamAuthorizedKeys) == 0 {
 		logger.Info("starting-tsa-without-authorized-keys")
 	}
 
+	revocationList, err := newRevocationList(logger.Session("revocation-list"), string(cmd.RevocationList))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load revocation list: %s", err)
+	}
+
+	keyRegistry := newKeyRegistry(
+		logger.Session("key-registry"),
+		cmd.AuthorizedKeys.Path,
+		cmd.teamAuthorizedKeyPaths(),
+		keySnapshot{
+			AuthorizedKeys:     cmd.AuthorizedKeys.Keys,
+			TeamAuthorizedKeys: teamAuthorizedKeys,
+		},
+	)
+
+	http.HandleFunc("/debug/key-registry", keyRegistry.DebugHandler())
+
+	stopWatching := make(chan struct{})
+	go keyRegistry.Watch(stopWatching)
+
 	sessionAuthTeam := &sessionTeam{
 		sessionTeams: make(map[string]string),
 		lock:         &sync.RWMutex{},
 	}
 
-	config, err := cmd.configureSSHServer(sessionAuthTeam, cmd.AuthorizedKeys.Keys, teamAuthorizedKeys)
+	auditSink, err := cmd.auditSink(logger.Session("audit-log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to configure audit log: %s", err)
+	}
+
+	auditLog := NewAuditLog(auditSink)
+
+	stopReaping := make(chan struct{})
+	go auditLog.Reap(stopReaping, 1*time.Minute, cmd.AuditLogMaxSessionAge)
+
+	sessionGossip := NewSessionGossip(
+		logger.Session("session-gossip"),
+		cmd.PeerAddress,
+		cmd.ATCURLs,
+		http.DefaultClient,
+		cmd.HeartbeatInterval,
+	)
+
+	stopGossiping := make(chan struct{})
+	go sessionGossip.Heartbeat(stopGossiping)
+
+	quotas := newConnectionQuotas(
+		cmd.MaxConcurrentSessionsPerTeam,
+		cmd.MaxConcurrentSessions,
+		rate.Limit(cmd.MaxConnectionsPerSecond),
+		cmd.MaxConnectionsBurst,
+		cmd.MaxSessionLease,
+	)
+	prometheus.MustRegister(quotas.collector)
+	http.Handle("/metrics", promhttp.Handler())
+
+	stopSweeping := make(chan struct{})
+	go quotas.Sweep(stopSweeping, 1*time.Minute)
+
+	config, err := cmd.configureSSHServer(sessionAuthTeam, keyRegistry, cmd.UserCA.Keys, teamUserCAs, revocationList)
 	if err != nil {
 		return nil, fmt.Errorf("failed to configure SSH server: %s", err)
 	}
 
+	// The connection-accept loop that calls ssh.NewServerConn(netConn,
+	// config) for each incoming connection, and that must call
+	// CompleteSession(sshConn, key, auditLog, sessionGossip, quotas) once
+	// that succeeds, lives in tsa/tsacmd/server.go, which this series
+	// doesn't touch.
+
 	listenAddr := fmt.Sprintf("%s:%d", cmd.BindIP, cmd.BindPort)
 
 	if cmd.SessionSigningKey == nil {
@@ -100,7 +187,7 @@ func (cmd *TSACommand) constructLogger(config concourse.WebConfig) (lager.Logger
 	return logger, reconfigurableSink
 }
 
-func (cmd *TSACommand) loadTeamAuthorizedKeys() ([]TeamAuthKeys, error) {
+func (cmd *TSACommand) teamAuthorizedKeys() []TeamAuthKeys {
 	var teamKeys []TeamAuthKeys
 
 	for teamName, keys := range cmd.TeamAuthorizedKeys {
@@ -110,12 +197,86 @@ func (cmd *TSACommand) loadTeamAuthorizedKeys() ([]TeamAuthKeys, error) {
 		})
 	}
 
-	return teamKeys, nil
+	return teamKeys
+}
+
+func (cmd *TSACommand) teamAuthorizedKeyPaths() map[string]string {
+	paths := make(map[string]string, len(cmd.TeamAuthorizedKeys))
+
+	for teamName, keys := range cmd.TeamAuthorizedKeys {
+		paths[teamName] = keys.Path
+	}
+
+	return paths
+}
+
+// auditSink builds the sink selected by the --audit-log-* flags. It's valid
+// to combine file, syslog, and S3 sinks, in which case events are recorded
+// to each in turn; if none are configured, events are simply discarded.
+func (cmd *TSACommand) auditSink(logger lager.Logger) (AuditSink, error) {
+	var sinks []AuditSink
+
+	if cmd.AuditLogFile != "" {
+		sink, err := NewFileAuditSink(cmd.AuditLogFile)
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	if cmd.AuditLogSyslog {
+		sink, err := NewSyslogAuditSink()
+		if err != nil {
+			return nil, err
+		}
+
+		sinks = append(sinks, sink)
+	}
+
+	if cmd.AuditLogS3.URL != nil {
+		sinks = append(sinks, NewS3AuditSink(logger.Session("s3"), cmd.AuditLogS3.String(), cmd.AuditLogS3Interval))
+	}
+
+	return multiAuditSink(sinks), nil
 }
 
-func (cmd *TSACommand) configureSSHServer(sessionAuthTeam *sessionTeam, authorizedKeys []ssh.PublicKey, teamAuthorizedKeys []TeamAuthKeys) (*ssh.ServerConfig, error) {
+func (cmd *TSACommand) loadTeamUserCAs() ([]TeamAuthKeys, error) {
+	var teamCAs []TeamAuthKeys
+
+	for teamName, keys := range cmd.TeamUserCA {
+		teamCAs = append(teamCAs, TeamAuthKeys{
+			Team:     teamName,
+			AuthKeys: keys.Keys,
+		})
+	}
+
+	return teamCAs, nil
+}
+
+func (cmd *TSACommand) configureSSHServer(
+	sessionAuthTeam *sessionTeam,
+	keyRegistry *keyRegistry,
+	userCAs []ssh.PublicKey,
+	teamUserCAs []TeamAuthKeys,
+	revocationList *revocationList,
+) (*ssh.ServerConfig, error) {
 	certChecker := &ssh.CertChecker{
 		IsUserAuthority: func(key ssh.PublicKey) bool {
+			for _, k := range userCAs {
+				if bytes.Equal(k.Marshal(), key.Marshal()) {
+					return true
+				}
+			}
+
+			for _, teamCA := range teamUserCAs {
+				for _, k := range teamCA.AuthKeys {
+					if bytes.Equal(k.Marshal(), key.Marshal()) {
+						return true
+					}
+				}
+			}
+
 			return false
 		},
 
@@ -123,18 +284,30 @@ func (cmd *TSACommand) configureSSHServer(sessionAuthTeam *sessionTeam, authoriz
 			return false
 		},
 
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return revocationList.IsRevoked(cert)
+		},
+
 		UserKeyFallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			for _, k := range authorizedKeys {
+			if revocationList.IsKeyRevoked(key) {
+				return nil, fmt.Errorf("key is revoked")
+			}
+
+			snapshot := keyRegistry.Snapshot()
+
+			for _, k := range snapshot.AuthorizedKeys {
 				if bytes.Equal(k.Marshal(), key.Marshal()) {
 					return nil, nil
 				}
 			}
 
-			for _, teamKeys := range teamAuthorizedKeys {
+			for _, teamKeys := range snapshot.TeamAuthorizedKeys {
 				for _, k := range teamKeys.AuthKeys {
 					if bytes.Equal(k.Marshal(), key.Marshal()) {
 						sessionAuthTeam.AuthorizeTeam(string(conn.SessionID()), teamKeys.Team)
-						return nil, nil
+						return &ssh.Permissions{
+							Extensions: map[string]string{"team": teamKeys.Team},
+						}, nil
 					}
 				}
 			}
@@ -146,7 +319,40 @@ func (cmd *TSACommand) configureSSHServer(sessionAuthTeam *sessionTeam, authoriz
 	config := &ssh.ServerConfig{
 		Config: atc.DefaultSSHConfig(),
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
-			return certChecker.Authenticate(conn, key)
+			perms, err := certChecker.Authenticate(conn, key)
+			if err != nil {
+				return nil, err
+			}
+
+			team := ""
+			if cert, ok := key.(*ssh.Certificate); ok {
+				if certTeam, found := teamForUserCert(cert, teamUserCAs); found {
+					sessionAuthTeam.AuthorizeTeam(string(conn.SessionID()), certTeam)
+					team = certTeam
+				}
+			} else if perms != nil {
+				// UserKeyFallback stashes the team a plain authorized_keys
+				// match resolved to in Permissions.Extensions, since
+				// CertChecker.Authenticate passes its return value straight
+				// through for non-certificate keys.
+				team = perms.Extensions["team"]
+			}
+
+			// Deliberately no quota/audit/gossip side effects here: per
+			// golang.org/x/crypto/ssh's own docs, PublicKeyCallback also
+			// fires for a client's unsigned "query" of whether a key would
+			// be accepted, with no signature ever required or verified, so
+			// "a call to this function does not guarantee that the key
+			// offered is in fact used to authenticate." Recording a session
+			// this early would let anyone who merely knows a team's public
+			// key or certificate - not its private key - burn a quota lease
+			// and pollute the audit log and session-gossip table without
+			// ever completing authentication. CompleteSession carries those
+			// side effects and must be called only once the handshake
+			// genuinely succeeds (ssh.NewServerConn returns without error).
+			return &ssh.Permissions{
+				Extensions: map[string]string{"team": team},
+			}, nil
 		},
 	}
 
@@ -160,6 +366,61 @@ func (cmd *TSACommand) configureSSHServer(sessionAuthTeam *sessionTeam, authoriz
 	return config, nil
 }
 
+// CompleteSession records a session's quota lease, audit log entry, and
+// session-gossip tracking for a connection whose authentication has
+// genuinely completed. It must be called with the *ssh.ServerConn returned
+// by a successful ssh.NewServerConn, never from PublicKeyCallback: the
+// golang.org/x/crypto/ssh package also invokes PublicKeyCallback for a
+// client's unsigned "query" of whether a key would be accepted, so doing
+// this from the callback would let anyone who merely knows an authorized
+// key - not its private key - consume a quota lease and pollute the audit
+// log and session-gossip table without ever authenticating.
+//
+// If the returned reason is non-empty, the session was rejected by quota
+// and the caller should close the connection; authentication has already
+// succeeded by this point, so there's no SSH auth error left to return it
+// through, only the connection itself to refuse.
+func CompleteSession(conn *ssh.ServerConn, key ssh.PublicKey, auditLog *AuditLog, sessionGossip *SessionGossip, quotas *connectionQuotas) (ok bool, rejectReason string) {
+	sessionID := string(conn.SessionID())
+	team := ""
+	if conn.Permissions != nil {
+		team = conn.Permissions.Extensions["team"]
+	}
+
+	if allowed, reason := quotas.Allow(team, sessionID); !allowed {
+		quotas.collector.CountRejection(team, reason)
+		return false, rejectionReason(team, reason)
+	}
+
+	auditLog.SessionStarted(sessionID, conn.RemoteAddr().String(), key, team)
+	sessionGossip.SessionStarted(sessionID)
+
+	return true, ""
+}
+
+// teamForUserCert derives the team that a worker authenticated with a
+// short-lived user certificate belongs to. A certificate signed by a
+// --team-user-ca is authorized for that team outright; otherwise the team
+// is read off a "team:NAME" principal, which lets a single shared CA issue
+// certificates for many teams.
+func teamForUserCert(cert *ssh.Certificate, teamUserCAs []TeamAuthKeys) (string, bool) {
+	for _, teamCA := range teamUserCAs {
+		for _, k := range teamCA.AuthKeys {
+			if bytes.Equal(k.Marshal(), cert.SignatureKey.Marshal()) {
+				return teamCA.Team, true
+			}
+		}
+	}
+
+	for _, principal := range cert.ValidPrincipals {
+		if strings.HasPrefix(principal, teamPrincipalPrefix) {
+			return strings.TrimPrefix(principal, teamPrincipalPrefix), true
+		}
+	}
+
+	return "", false
+}
+
 func (cmd *TSACommand) debugBindAddr() string {
 	return fmt.Sprintf("%s:%d", cmd.DebugBindIP, cmd.DebugBindPort)
 }
@@ -0,0 +1,142 @@
+package tsacmd
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeAddr is a minimal net.Addr for tests that never actually dial out.
+type fakeAddr string
+
+func (a fakeAddr) Network() string { return "tcp" }
+func (a fakeAddr) String() string  { return string(a) }
+
+// fakeServerConn implements ssh.Conn with just enough behavior to exercise
+// code that only reads a connection's identity, never its data plane.
+type fakeServerConn struct {
+	sessionID []byte
+}
+
+func (c *fakeServerConn) User() string          { return "" }
+func (c *fakeServerConn) SessionID() []byte     { return c.sessionID }
+func (c *fakeServerConn) ClientVersion() []byte { return nil }
+func (c *fakeServerConn) ServerVersion() []byte { return nil }
+func (c *fakeServerConn) RemoteAddr() net.Addr  { return fakeAddr("10.0.0.9:1234") }
+func (c *fakeServerConn) LocalAddr() net.Addr   { return fakeAddr("10.0.0.1:22") }
+func (c *fakeServerConn) Close() error          { return nil }
+func (c *fakeServerConn) Wait() error           { return nil }
+func (c *fakeServerConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	return false, nil, nil
+}
+func (c *fakeServerConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	return nil, nil, errors.New("not supported by fakeServerConn")
+}
+
+func TestTeamForUserCertFromTeamCA(t *testing.T) {
+	caKey := testRSAKey(t)
+	cert := &ssh.Certificate{
+		SignatureKey: caKey,
+	}
+
+	team, found := teamForUserCert(cert, []TeamAuthKeys{
+		{Team: "main", AuthKeys: []ssh.PublicKey{caKey}},
+	})
+	if !found {
+		t.Fatalf("expected a cert signed by a registered team CA to resolve a team")
+	}
+	if team != "main" {
+		t.Fatalf("expected team %q, got %q", "main", team)
+	}
+}
+
+func TestTeamForUserCertFromPrincipal(t *testing.T) {
+	cert := &ssh.Certificate{
+		SignatureKey:    testRSAKey(t),
+		ValidPrincipals: []string{"worker-1", "team:other"},
+	}
+
+	team, found := teamForUserCert(cert, nil)
+	if !found {
+		t.Fatalf("expected a team: principal to resolve a team")
+	}
+	if team != "other" {
+		t.Fatalf("expected team %q, got %q", "other", team)
+	}
+}
+
+func TestTeamForUserCertUnresolved(t *testing.T) {
+	cert := &ssh.Certificate{
+		SignatureKey:    testRSAKey(t),
+		ValidPrincipals: []string{"worker-1"},
+	}
+
+	_, found := teamForUserCert(cert, nil)
+	if found {
+		t.Fatalf("expected no team to resolve when neither a team CA nor a team: principal matches")
+	}
+}
+
+func TestCompleteSessionRecordsQuotaAuditAndGossip(t *testing.T) {
+	conn := &ssh.ServerConn{
+		Conn:        &fakeServerConn{sessionID: []byte("session-1")},
+		Permissions: &ssh.Permissions{Extensions: map[string]string{"team": "main"}},
+	}
+
+	auditLog := NewAuditLog(recordingAuditSink{})
+	sessionGossip := newTestSessionGossip(t)
+	quotas := newConnectionQuotas(1, 0, 0, 0, time.Hour)
+
+	ok, reason := CompleteSession(conn, testRSAKey(t), auditLog, sessionGossip, quotas)
+	if !ok {
+		t.Fatalf("expected the first session for team main to be allowed, got rejection %q", reason)
+	}
+
+	if len(sessionGossip.snapshot()) != 1 {
+		t.Fatalf("expected CompleteSession to start tracking the session in session-gossip")
+	}
+
+	if _, found := auditLog.sessions["session-1"]; !found {
+		t.Fatalf("expected CompleteSession to start tracking the session in the audit log")
+	}
+
+	if _, found := quotas.perTeam["main"]["session-1"]; !found {
+		t.Fatalf("expected CompleteSession to reserve a quota lease for the session")
+	}
+}
+
+func TestCompleteSessionRejectsOverQuotaWithoutRecordingSideEffects(t *testing.T) {
+	quotas := newConnectionQuotas(1, 0, 0, 0, time.Hour)
+	quotas.Allow("main", "existing-session")
+
+	auditLog := NewAuditLog(recordingAuditSink{})
+	sessionGossip := newTestSessionGossip(t)
+
+	conn := &ssh.ServerConn{
+		Conn:        &fakeServerConn{sessionID: []byte("session-2")},
+		Permissions: &ssh.Permissions{Extensions: map[string]string{"team": "main"}},
+	}
+
+	ok, reason := CompleteSession(conn, testRSAKey(t), auditLog, sessionGossip, quotas)
+	if ok {
+		t.Fatalf("expected a second concurrent session for team main to be rejected")
+	}
+	if reason == "" {
+		t.Fatalf("expected a non-empty rejection reason")
+	}
+
+	if len(sessionGossip.snapshot()) != 0 {
+		t.Fatalf("expected a rejected session not to be tracked in session-gossip")
+	}
+}
+
+// recordingAuditSink is a no-op AuditSink; CompleteSession's tests assert
+// on the audit log's in-flight sessions, quotas and session-gossip, none of
+// which require inspecting what was recorded to the sink.
+type recordingAuditSink struct{}
+
+func (recordingAuditSink) Record(AuditEvent) {}
+func (recordingAuditSink) Close() error      { return nil }
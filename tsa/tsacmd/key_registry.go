@@ -0,0 +1,270 @@
+package tsacmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/ssh"
+)
+
+// keySnapshot is an immutable view of the authorized keys that the TSA
+// currently trusts. A fresh snapshot is swapped in atomically whenever the
+// backing files are reloaded, so in-flight authentications always see a
+// consistent set of keys.
+type keySnapshot struct {
+	AuthorizedKeys     []ssh.PublicKey
+	TeamAuthorizedKeys []TeamAuthKeys
+}
+
+// KeyReloadResult describes the outcome of a single reload of the
+// authorized_keys registry, and is what's exposed over the debug endpoint
+// so operators can confirm a key rotation took effect before revoking the
+// old key.
+type KeyReloadResult struct {
+	Time               time.Time         `json:"time"`
+	AuthorizedKeyCount int               `json:"authorized_key_count"`
+	TeamKeyCounts      map[string]int    `json:"team_key_counts"`
+	Errors             map[string]string `json:"errors,omitempty"`
+}
+
+// keyRegistry holds the authorized_keys and team-authorized-keys files that
+// back the TSA's SSH server, and knows how to re-read them from disk
+// without requiring the caller to restart the process. UserKeyFallback
+// reads through Snapshot(), so a reload takes effect for the very next
+// incoming connection.
+type keyRegistry struct {
+	logger lager.Logger
+
+	authorizedKeysPath     string
+	teamAuthorizedKeyPaths map[string]string
+
+	snapshot   atomic.Value // keySnapshot
+	lastReload atomic.Value // KeyReloadResult
+}
+
+func newKeyRegistry(
+	logger lager.Logger,
+	authorizedKeysPath string,
+	teamAuthorizedKeyPaths map[string]string,
+	initial keySnapshot,
+) *keyRegistry {
+	r := &keyRegistry{
+		logger:                 logger,
+		authorizedKeysPath:     authorizedKeysPath,
+		teamAuthorizedKeyPaths: teamAuthorizedKeyPaths,
+	}
+
+	r.snapshot.Store(initial)
+	r.lastReload.Store(KeyReloadResult{
+		Time:               time.Unix(0, 0),
+		AuthorizedKeyCount: len(initial.AuthorizedKeys),
+		TeamKeyCounts:      teamKeyCounts(initial.TeamAuthorizedKeys),
+	})
+
+	return r
+}
+
+// Snapshot returns the currently trusted keys. It's safe to call
+// concurrently with Reload.
+func (r *keyRegistry) Snapshot() keySnapshot {
+	return r.snapshot.Load().(keySnapshot)
+}
+
+// LastReload returns the result of the most recent call to Reload, or a
+// zero-error result describing the keys the registry was constructed with.
+func (r *keyRegistry) LastReload() KeyReloadResult {
+	return r.lastReload.Load().(KeyReloadResult)
+}
+
+// Reload re-reads every backing file from disk and swaps in a new
+// snapshot. A file that fails to load keeps the keys it had in the
+// previous snapshot; its error is recorded, and the other files still
+// take effect.
+func (r *keyRegistry) Reload() KeyReloadResult {
+	result := KeyReloadResult{
+		Time:          time.Now(),
+		TeamKeyCounts: map[string]int{},
+		Errors:        map[string]string{},
+	}
+
+	next := keySnapshot{}
+
+	authorizedKeys, err := loadAuthorizedKeysFile(r.authorizedKeysPath)
+	if err != nil {
+		result.Errors[r.authorizedKeysPath] = err.Error()
+		next.AuthorizedKeys = r.Snapshot().AuthorizedKeys
+	} else {
+		next.AuthorizedKeys = authorizedKeys
+	}
+	result.AuthorizedKeyCount = len(next.AuthorizedKeys)
+
+	previousTeamKeys := map[string][]ssh.PublicKey{}
+	for _, teamKeys := range r.Snapshot().TeamAuthorizedKeys {
+		previousTeamKeys[teamKeys.Team] = teamKeys.AuthKeys
+	}
+
+	for team, path := range r.teamAuthorizedKeyPaths {
+		keys, err := loadAuthorizedKeysFile(path)
+		if err != nil {
+			result.Errors[path] = err.Error()
+			keys = previousTeamKeys[team]
+		}
+
+		next.TeamAuthorizedKeys = append(next.TeamAuthorizedKeys, TeamAuthKeys{
+			Team:     team,
+			AuthKeys: keys,
+		})
+		result.TeamKeyCounts[team] = len(keys)
+	}
+
+	if len(result.Errors) == 0 {
+		result.Errors = nil
+	}
+
+	r.snapshot.Store(next)
+	r.lastReload.Store(result)
+
+	r.logger.Info("reloaded-authorized-keys", lager.Data{
+		"authorized-key-count": result.AuthorizedKeyCount,
+		"team-key-counts":      result.TeamKeyCounts,
+		"errors":               result.Errors,
+	})
+
+	return result
+}
+
+// Watch reloads the registry on SIGHUP and whenever any backing file
+// changes on disk, until stop is closed.
+//
+// It watches each backing file's parent directory rather than the file
+// itself: most "rotate a file on a running container" setups (a
+// Kubernetes Secret/ConfigMap volume, an atomic `ln -sfn` swap) replace
+// the file by renaming a new one into place, which removes the inode a
+// direct file watch is tracking. Watching the directory survives that,
+// since the directory itself isn't replaced - only events for the
+// specific filenames being tracked trigger a reload.
+func (r *keyRegistry) Watch(stop <-chan struct{}) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		r.logger.Error("failed-to-create-watcher", err)
+		watcher = nil
+	}
+
+	if watcher != nil {
+		for _, dir := range r.watchedDirs() {
+			if err := watcher.Add(dir); err != nil {
+				r.logger.Error("failed-to-watch-directory", err, lager.Data{"dir": dir})
+			}
+		}
+	}
+
+	watchedNames := r.watchedBasenames()
+
+	for {
+		select {
+		case <-sighup:
+			r.Reload()
+
+		case event := <-r.watcherEvents(watcher):
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 && watchedNames[filepath.Base(event.Name)] {
+				r.Reload()
+			}
+
+		case <-stop:
+			signal.Stop(sighup)
+			if watcher != nil {
+				watcher.Close()
+			}
+			return
+		}
+	}
+}
+
+func (r *keyRegistry) watcherEvents(watcher *fsnotify.Watcher) chan fsnotify.Event {
+	if watcher == nil {
+		return nil
+	}
+
+	return watcher.Events
+}
+
+func (r *keyRegistry) watchedPaths() []string {
+	var paths []string
+
+	if r.authorizedKeysPath != "" {
+		paths = append(paths, r.authorizedKeysPath)
+	}
+
+	for _, path := range r.teamAuthorizedKeyPaths {
+		paths = append(paths, path)
+	}
+
+	return paths
+}
+
+// watchedDirs returns the deduplicated set of parent directories of every
+// backing file, so that registries whose files share a directory (as a
+// Kubernetes volume mount typically would) don't register the same watch
+// twice.
+func (r *keyRegistry) watchedDirs() []string {
+	seen := map[string]bool{}
+
+	var dirs []string
+	for _, path := range r.watchedPaths() {
+		dir := filepath.Dir(path)
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	return dirs
+}
+
+// watchedBasenames returns the set of backing file names a directory event
+// should be checked against before triggering a reload, so that unrelated
+// churn elsewhere in a shared directory doesn't cause one.
+func (r *keyRegistry) watchedBasenames() map[string]bool {
+	names := map[string]bool{}
+
+	for _, path := range r.watchedPaths() {
+		names[filepath.Base(path)] = true
+	}
+
+	return names
+}
+
+// DebugHandler serves the result of the most recent reload as JSON, so
+// operators can verify a key rotation took effect before revoking the old
+// key.
+func (r *keyRegistry) DebugHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(r.LastReload())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+func teamKeyCounts(teamKeys []TeamAuthKeys) map[string]int {
+	counts := map[string]int{}
+
+	for _, teamKey := range teamKeys {
+		counts[teamKey.Team] = len(teamKey.AuthKeys)
+	}
+
+	return counts
+}
@@ -0,0 +1,130 @@
+package tsacmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeAuthorizedKeysFile(t *testing.T, dir string, name string, keys ...ssh.PublicKey) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+
+	var bs []byte
+	for _, key := range keys {
+		bs = append(bs, ssh.MarshalAuthorizedKey(key)...)
+	}
+
+	if err := os.WriteFile(path, bs, 0600); err != nil {
+		t.Fatalf("failed to write authorized keys file: %s", err)
+	}
+
+	return path
+}
+
+func TestKeyRegistryReloadPicksUpNewKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyA := testRSAKey(t)
+	keyB := testRSAKey(t)
+
+	path := writeAuthorizedKeysFile(t, dir, "authorized_keys", keyA)
+
+	registry := newKeyRegistry(lagertest.NewTestLogger("key-registry"), path, nil, keySnapshot{})
+
+	if count := len(registry.Snapshot().AuthorizedKeys); count != 0 {
+		t.Fatalf("expected no keys before the first Reload, got %d", count)
+	}
+
+	writeAuthorizedKeysFile(t, dir, "authorized_keys", keyA, keyB)
+
+	result := registry.Reload()
+	if result.AuthorizedKeyCount != 2 {
+		t.Fatalf("expected 2 authorized keys after reload, got %d", result.AuthorizedKeyCount)
+	}
+	if len(result.Errors) != 0 {
+		t.Fatalf("expected no errors, got %v", result.Errors)
+	}
+	if count := len(registry.Snapshot().AuthorizedKeys); count != 2 {
+		t.Fatalf("expected the snapshot to reflect 2 keys, got %d", count)
+	}
+}
+
+func TestKeyRegistryReloadKeepsPreviousKeysOnError(t *testing.T) {
+	dir := t.TempDir()
+	keyA := testRSAKey(t)
+
+	path := writeAuthorizedKeysFile(t, dir, "authorized_keys", keyA)
+
+	registry := newKeyRegistry(lagertest.NewTestLogger("key-registry"), path, nil, keySnapshot{})
+	registry.Reload()
+
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove authorized keys file: %s", err)
+	}
+
+	result := registry.Reload()
+	if len(result.Errors) == 0 {
+		t.Fatalf("expected an error when the backing file is gone")
+	}
+	if count := len(registry.Snapshot().AuthorizedKeys); count != 1 {
+		t.Fatalf("expected the previous snapshot's keys to be kept on a failed reload, got %d", count)
+	}
+}
+
+func TestKeyRegistryReloadTracksPerTeamCounts(t *testing.T) {
+	dir := t.TempDir()
+	keyA := testRSAKey(t)
+	keyB := testRSAKey(t)
+
+	teamAPath := writeAuthorizedKeysFile(t, dir, "team-a", keyA)
+	teamBPath := writeAuthorizedKeysFile(t, dir, "team-b", keyA, keyB)
+
+	registry := newKeyRegistry(lagertest.NewTestLogger("key-registry"), "", map[string]string{
+		"team-a": teamAPath,
+		"team-b": teamBPath,
+	}, keySnapshot{})
+
+	result := registry.Reload()
+	if result.TeamKeyCounts["team-a"] != 1 {
+		t.Fatalf("expected team-a to have 1 key, got %d", result.TeamKeyCounts["team-a"])
+	}
+	if result.TeamKeyCounts["team-b"] != 2 {
+		t.Fatalf("expected team-b to have 2 keys, got %d", result.TeamKeyCounts["team-b"])
+	}
+}
+
+func TestKeyRegistryWatchedDirsDedupesSharedDirectory(t *testing.T) {
+	dir := t.TempDir()
+
+	registry := newKeyRegistry(lagertest.NewTestLogger("key-registry"), filepath.Join(dir, "authorized_keys"), map[string]string{
+		"team-a": filepath.Join(dir, "team-a"),
+	}, keySnapshot{})
+
+	dirs := registry.watchedDirs()
+	if len(dirs) != 1 {
+		t.Fatalf("expected files sharing a directory to be watched once, got %v", dirs)
+	}
+	if dirs[0] != dir {
+		t.Fatalf("expected %q, got %q", dir, dirs[0])
+	}
+}
+
+func TestKeyRegistryWatchedBasenamesTracksEachFile(t *testing.T) {
+	dir := t.TempDir()
+
+	registry := newKeyRegistry(lagertest.NewTestLogger("key-registry"), filepath.Join(dir, "authorized_keys"), map[string]string{
+		"team-a": filepath.Join(dir, "team-a"),
+	}, keySnapshot{})
+
+	names := registry.watchedBasenames()
+	if !names["authorized_keys"] || !names["team-a"] {
+		t.Fatalf("expected both backing files' basenames to be tracked, got %v", names)
+	}
+	if names["unrelated-file"] {
+		t.Fatalf("expected an unrelated filename not to be tracked")
+	}
+}
@@ -0,0 +1,262 @@
+package tsacmd
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+// quotaRejectedReason identifies why a connection was rejected by
+// connectionQuotas, and is used as the "reason" label on the
+// tsa_rejected_connections_total metric.
+type quotaRejectedReason string
+
+const (
+	quotaRejectedTeamConcurrency   quotaRejectedReason = "team-concurrency"
+	quotaRejectedTeamRate          quotaRejectedReason = "team-rate"
+	quotaRejectedGlobalConcurrency quotaRejectedReason = "global-concurrency"
+)
+
+// connectionQuotas enforces, per team, a maximum number of concurrent
+// worker SSH sessions and a maximum rate of new connections, plus a single
+// global cap on concurrent sessions across all teams. This keeps a runaway
+// team from exhausting the TSA's file descriptors or the ATC's worker
+// slots in a multi-tenant install.
+//
+// Concurrency slots are tracked as leases keyed by session ID rather than a
+// bare counter: Release should be called by the request-dispatch layer as
+// soon as a session actually closes, but since that wiring doesn't exist in
+// this series, a lease also expires on its own after maxLease. Without
+// that, a counter-only implementation would only ever grow, and once
+// cumulative (not concurrent) connections reached the configured maximum
+// the TSA would reject every future connection forever.
+type connectionQuotas struct {
+	maxConcurrentPerTeam int
+	maxGlobalConcurrent  int
+	newConnectionRate    rate.Limit
+	newConnectionBurst   int
+	maxLease             time.Duration
+
+	lock      sync.Mutex
+	perTeam   map[string]map[string]time.Time // team -> session ID -> lease expiry
+	limiters  map[string]*rate.Limiter
+	collector *quotaCollector
+}
+
+func newConnectionQuotas(maxConcurrentPerTeam int, maxGlobalConcurrent int, newConnectionRate rate.Limit, newConnectionBurst int, maxLease time.Duration) *connectionQuotas {
+	q := &connectionQuotas{
+		maxConcurrentPerTeam: maxConcurrentPerTeam,
+		maxGlobalConcurrent:  maxGlobalConcurrent,
+		newConnectionRate:    newConnectionRate,
+		newConnectionBurst:   newConnectionBurst,
+		maxLease:             maxLease,
+
+		perTeam:  make(map[string]map[string]time.Time),
+		limiters: make(map[string]*rate.Limiter),
+	}
+
+	q.collector = newQuotaCollector(q)
+
+	return q
+}
+
+func (q *connectionQuotas) limiterFor(team string) *rate.Limiter {
+	limiter, found := q.limiters[team]
+	if !found {
+		limiter = rate.NewLimiter(q.newConnectionRate, q.newConnectionBurst)
+		q.limiters[team] = limiter
+	}
+
+	return limiter
+}
+
+// total returns the number of unexpired leases across every team. Callers
+// must hold q.lock.
+func (q *connectionQuotas) total(now time.Time) int {
+	total := 0
+
+	for _, leases := range q.perTeam {
+		for _, expiry := range leases {
+			if expiry.After(now) {
+				total++
+			}
+		}
+	}
+
+	return total
+}
+
+// activeForTeam returns the number of unexpired leases for team. Callers
+// must hold q.lock.
+func (q *connectionQuotas) activeForTeam(team string, now time.Time) int {
+	active := 0
+
+	for _, expiry := range q.perTeam[team] {
+		if expiry.After(now) {
+			active++
+		}
+	}
+
+	return active
+}
+
+// Allow checks whether a new connection for the given team may proceed,
+// and if so reserves a lease for sessionID. Release should be called once
+// the session ends; if it never is, the lease expires on its own after
+// maxLease.
+func (q *connectionQuotas) Allow(team string, sessionID string) (bool, quotaRejectedReason) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+
+	if q.maxGlobalConcurrent > 0 && q.total(now) >= q.maxGlobalConcurrent {
+		return false, quotaRejectedGlobalConcurrency
+	}
+
+	if q.newConnectionRate > 0 && !q.limiterFor(team).Allow() {
+		return false, quotaRejectedTeamRate
+	}
+
+	if q.maxConcurrentPerTeam > 0 && q.activeForTeam(team, now) >= q.maxConcurrentPerTeam {
+		return false, quotaRejectedTeamConcurrency
+	}
+
+	if q.perTeam[team] == nil {
+		q.perTeam[team] = make(map[string]time.Time)
+	}
+	q.perTeam[team][sessionID] = now.Add(q.maxLease)
+
+	return true, ""
+}
+
+// Release frees the lease reserved by a prior successful call to Allow for
+// the given team and session.
+func (q *connectionQuotas) Release(team string, sessionID string) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	delete(q.perTeam[team], sessionID)
+}
+
+// Sweep drops expired leases until stop is closed. Allow and the
+// active-session gauge already ignore expired leases; sweeping frees them
+// from memory and drops teams with no leases left from the gauge.
+func (q *connectionQuotas) Sweep(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			q.sweepOnce()
+
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (q *connectionQuotas) sweepOnce() {
+	now := time.Now()
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for team, leases := range q.perTeam {
+		for sessionID, expiry := range leases {
+			if !expiry.After(now) {
+				delete(leases, sessionID)
+			}
+		}
+
+		if len(leases) == 0 {
+			delete(q.perTeam, team)
+		}
+	}
+}
+
+func (q *connectionQuotas) activeSessions() map[string]int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	now := time.Now()
+
+	counts := make(map[string]int, len(q.perTeam))
+	for team := range q.perTeam {
+		counts[team] = q.activeForTeam(team, now)
+	}
+
+	return counts
+}
+
+// quotaCollector exposes connectionQuotas' rejection counts and active
+// session gauges as Prometheus metrics on the debug listener.
+type quotaCollector struct {
+	quotas *connectionQuotas
+
+	rejectedDesc *prometheus.Desc
+	activeDesc   *prometheus.Desc
+
+	lock     sync.Mutex
+	rejected map[[2]string]float64
+}
+
+func newQuotaCollector(quotas *connectionQuotas) *quotaCollector {
+	return &quotaCollector{
+		quotas: quotas,
+
+		rejectedDesc: prometheus.NewDesc(
+			"tsa_rejected_connections_total",
+			"Total number of SSH connections rejected by the TSA's per-team and global quotas.",
+			[]string{"team", "reason"},
+			nil,
+		),
+		activeDesc: prometheus.NewDesc(
+			"tsa_active_sessions",
+			"Number of concurrent SSH sessions currently held open by the TSA, per team.",
+			[]string{"team"},
+			nil,
+		),
+
+		rejected: make(map[[2]string]float64),
+	}
+}
+
+// CountRejection records a rejected connection for the given team and
+// reason, to be reported the next time Prometheus scrapes the collector.
+func (c *quotaCollector) CountRejection(team string, reason quotaRejectedReason) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.rejected[[2]string{team, string(reason)}]++
+}
+
+func (c *quotaCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.rejectedDesc
+	ch <- c.activeDesc
+}
+
+func (c *quotaCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	for key, count := range c.rejected {
+		ch <- prometheus.MustNewConstMetric(c.rejectedDesc, prometheus.CounterValue, count, key[0], key[1])
+	}
+	c.lock.Unlock()
+
+	for team, count := range c.quotas.activeSessions() {
+		ch <- prometheus.MustNewConstMetric(c.activeDesc, prometheus.GaugeValue, float64(count), team)
+	}
+}
+
+// rejectionReason formats why a connection was rejected by a quota.
+// CompleteSession returns it to its caller once authentication has
+// already completed, so it is not sent to the connecting client as an SSH
+// auth error or banner; the bare reason is counted on the
+// tsa_rejected_connections_total{reason} metric.
+func rejectionReason(team string, reason quotaRejectedReason) string {
+	return fmt.Sprintf("connection rejected: %s quota exceeded for team %q; retry after a short delay", reason, team)
+}
@@ -0,0 +1,66 @@
+package tsacmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnectionQuotasPerTeamConcurrency(t *testing.T) {
+	quotas := newConnectionQuotas(1, 0, 0, 0, time.Hour)
+
+	allowed, _ := quotas.Allow("team-a", "session-1")
+	if !allowed {
+		t.Fatalf("expected first session for team-a to be allowed")
+	}
+
+	allowed, reason := quotas.Allow("team-a", "session-2")
+	if allowed {
+		t.Fatalf("expected second concurrent session for team-a to be rejected")
+	}
+	if reason != quotaRejectedTeamConcurrency {
+		t.Fatalf("expected team-concurrency rejection, got %q", reason)
+	}
+
+	allowed, _ = quotas.Allow("team-b", "session-3")
+	if !allowed {
+		t.Fatalf("expected team-b's own quota to be unaffected by team-a's usage")
+	}
+}
+
+func TestConnectionQuotasReleaseFreesSlot(t *testing.T) {
+	quotas := newConnectionQuotas(1, 0, 0, 0, time.Hour)
+
+	quotas.Allow("team-a", "session-1")
+	quotas.Release("team-a", "session-1")
+
+	allowed, _ := quotas.Allow("team-a", "session-2")
+	if !allowed {
+		t.Fatalf("expected a released slot to be reusable")
+	}
+}
+
+func TestConnectionQuotasLeaseExpiresWithoutRelease(t *testing.T) {
+	quotas := newConnectionQuotas(1, 0, 0, 0, -1*time.Second)
+
+	quotas.Allow("team-a", "session-1")
+	quotas.sweepOnce()
+
+	allowed, _ := quotas.Allow("team-a", "session-2")
+	if !allowed {
+		t.Fatalf("expected an expired lease to be swept so cumulative (not concurrent) usage doesn't permanently exhaust the quota")
+	}
+}
+
+func TestConnectionQuotasGlobalConcurrency(t *testing.T) {
+	quotas := newConnectionQuotas(0, 1, 0, 0, time.Hour)
+
+	quotas.Allow("team-a", "session-1")
+
+	allowed, reason := quotas.Allow("team-b", "session-2")
+	if allowed {
+		t.Fatalf("expected the global cap to reject a second team's session")
+	}
+	if reason != quotaRejectedGlobalConcurrency {
+		t.Fatalf("expected global-concurrency rejection, got %q", reason)
+	}
+}
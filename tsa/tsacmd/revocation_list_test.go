@@ -0,0 +1,96 @@
+package tsacmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"code.cloudfoundry.org/lager/lagertest"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRevocationListNoPathNeverRevoked(t *testing.T) {
+	r, err := newRevocationList(lagertest.NewTestLogger("revocation-list"), "")
+	if err != nil {
+		t.Fatalf("expected no error with an empty path, got %s", err)
+	}
+
+	if r.IsRevoked(&ssh.Certificate{}) {
+		t.Fatalf("expected no certificate to be revoked when no revocation list is configured")
+	}
+	if r.IsKeyRevoked(testRSAKey(t)) {
+		t.Fatalf("expected no key to be revoked when no revocation list is configured")
+	}
+}
+
+func TestRevocationListNilNeverRevoked(t *testing.T) {
+	var r *revocationList
+
+	if r.IsRevoked(&ssh.Certificate{}) {
+		t.Fatalf("expected a nil revocation list to treat nothing as revoked")
+	}
+	if r.IsKeyRevoked(testRSAKey(t)) {
+		t.Fatalf("expected a nil revocation list to treat nothing as revoked")
+	}
+}
+
+func TestRevocationListRevokesByKey(t *testing.T) {
+	revokedKey := testRSAKey(t)
+	okKey := testRSAKey(t)
+
+	path := filepath.Join(t.TempDir(), "revoked")
+	contents := "# revoked workers\n" + string(ssh.MarshalAuthorizedKey(revokedKey))
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("failed to write revocation list: %s", err)
+	}
+
+	r, err := newRevocationList(lagertest.NewTestLogger("revocation-list"), path)
+	if err != nil {
+		t.Fatalf("failed to load revocation list: %s", err)
+	}
+
+	if !r.IsKeyRevoked(revokedKey) {
+		t.Fatalf("expected the listed key to be revoked")
+	}
+	if r.IsKeyRevoked(okKey) {
+		t.Fatalf("expected an unlisted key not to be revoked")
+	}
+
+	if !r.IsRevoked(&ssh.Certificate{Key: revokedKey}) {
+		t.Fatalf("expected a certificate whose certified key is revoked to be revoked")
+	}
+	if r.IsRevoked(&ssh.Certificate{Key: okKey}) {
+		t.Fatalf("expected a certificate whose certified key isn't listed not to be revoked")
+	}
+}
+
+func TestRevocationListRevokesBySerial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("serial 42\n"), 0600); err != nil {
+		t.Fatalf("failed to write revocation list: %s", err)
+	}
+
+	r, err := newRevocationList(lagertest.NewTestLogger("revocation-list"), path)
+	if err != nil {
+		t.Fatalf("failed to load revocation list: %s", err)
+	}
+
+	if !r.IsRevoked(&ssh.Certificate{Key: testRSAKey(t), Serial: 42}) {
+		t.Fatalf("expected a certificate with the listed serial to be revoked")
+	}
+	if r.IsRevoked(&ssh.Certificate{Key: testRSAKey(t), Serial: 43}) {
+		t.Fatalf("expected a certificate with an unlisted serial not to be revoked")
+	}
+}
+
+func TestRevocationListReloadRejectsMalformedLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revoked")
+	if err := os.WriteFile(path, []byte("not a valid key or serial line\n"), 0600); err != nil {
+		t.Fatalf("failed to write revocation list: %s", err)
+	}
+
+	_, err := newRevocationList(lagertest.NewTestLogger("revocation-list"), path)
+	if err == nil {
+		t.Fatalf("expected a malformed revocation list line to fail to load")
+	}
+}
@@ -0,0 +1,153 @@
+package tsacmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"code.cloudfoundry.org/lager"
+	"github.com/concourse/concourse/atc"
+	"github.com/concourse/flag"
+)
+
+// SessionGossip heartbeats the set of SSH sessions this TSA instance is
+// holding open to the ATC, so that the ATC knows which web node to proxy a
+// `hijack`, `land-worker`, or `retire-worker` command to instead of picking
+// one at random. Each role heartbeats itself into the cluster the same way
+// the TSA already heartbeats workers it registers.
+type SessionGossip struct {
+	logger      lager.Logger
+	peerAddress string
+	atcURLs     []flag.URL
+	httpClient  *http.Client
+	interval    time.Duration
+
+	lock     sync.Mutex
+	sessions map[string]*atc.TSASession
+}
+
+func NewSessionGossip(
+	logger lager.Logger,
+	peerAddress string,
+	atcURLs []flag.URL,
+	httpClient *http.Client,
+	interval time.Duration,
+) *SessionGossip {
+	return &SessionGossip{
+		logger:      logger,
+		peerAddress: peerAddress,
+		atcURLs:     atcURLs,
+		httpClient:  httpClient,
+		interval:    interval,
+
+		sessions: make(map[string]*atc.TSASession),
+	}
+}
+
+// SessionStarted begins tracking a newly accepted SSH session.
+func (g *SessionGossip) SessionStarted(sessionID string) {
+	now := time.Now()
+
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	g.sessions[sessionID] = &atc.TSASession{
+		PeerAddress: g.peerAddress,
+		SessionID:   sessionID,
+		StartedAt:   now,
+		LastSeen:    now,
+	}
+}
+
+// SessionRegistered records the worker name a session identified itself as
+// once it's known, e.g. after a register-worker request.
+func (g *SessionGossip) SessionRegistered(sessionID string, workerName string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	if session, found := g.sessions[sessionID]; found {
+		session.WorkerName = workerName
+	}
+}
+
+// SessionEnded stops tracking a session. A "goodbye" heartbeat is sent on
+// the next tick so the ATC can expire its record promptly rather than
+// waiting out the TTL.
+func (g *SessionGossip) SessionEnded(sessionID string) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	delete(g.sessions, sessionID)
+}
+
+// Heartbeat periodically POSTs the current set of live sessions to the
+// ATC's /api/v1/tsa/sessions endpoint, until stop is closed, at which point
+// it sends a final empty heartbeat as a goodbye.
+func (g *SessionGossip) Heartbeat(stop <-chan struct{}) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			g.send(g.snapshot())
+
+		case <-stop:
+			g.send(nil)
+			return
+		}
+	}
+}
+
+func (g *SessionGossip) snapshot() []atc.TSASession {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	now := time.Now()
+
+	sessions := make([]atc.TSASession, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		session.LastSeen = now
+		sessions = append(sessions, *session)
+	}
+
+	return sessions
+}
+
+func (g *SessionGossip) send(sessions []atc.TSASession) {
+	payload, err := json.Marshal(sessions)
+	if err != nil {
+		g.logger.Error("failed-to-marshal-sessions", err)
+		return
+	}
+
+	atcURL := g.atcURLs[rand.Intn(len(g.atcURLs))]
+
+	// Always identify ourselves by peer_address, even on an empty goodbye
+	// heartbeat: the ATC can only know which peer's sessions to drop from
+	// the payload itself when it's non-empty, so without this an empty
+	// goodbye would clear nothing and stale entries would linger for the
+	// full TTL instead of being dropped immediately.
+	req, err := http.NewRequest("POST", atcURL.String()+"/api/v1/tsa/sessions?peer_address="+url.QueryEscape(g.peerAddress), bytes.NewReader(payload))
+	if err != nil {
+		g.logger.Error("failed-to-build-heartbeat-request", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		g.logger.Error("failed-to-heartbeat-sessions", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		g.logger.Error("heartbeat-sessions-rejected", fmt.Errorf("unexpected status: %s", resp.Status))
+	}
+}
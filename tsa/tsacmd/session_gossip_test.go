@@ -0,0 +1,54 @@
+package tsacmd
+
+import (
+	"testing"
+
+	"code.cloudfoundry.org/lager/lagertest"
+)
+
+func newTestSessionGossip(t *testing.T) *SessionGossip {
+	t.Helper()
+
+	return NewSessionGossip(lagertest.NewTestLogger("session-gossip"), "10.0.0.1:7777", nil, nil, 0)
+}
+
+func TestSessionGossipSnapshotReflectsLifecycle(t *testing.T) {
+	g := newTestSessionGossip(t)
+
+	g.SessionStarted("session-1")
+
+	snapshot := g.snapshot()
+	if len(snapshot) != 1 {
+		t.Fatalf("expected 1 session after SessionStarted, got %d", len(snapshot))
+	}
+	if snapshot[0].WorkerName != "" {
+		t.Fatalf("expected no worker name before SessionRegistered, got %q", snapshot[0].WorkerName)
+	}
+	if snapshot[0].PeerAddress != "10.0.0.1:7777" {
+		t.Fatalf("expected snapshot entries to carry this instance's peer address, got %q", snapshot[0].PeerAddress)
+	}
+
+	g.SessionRegistered("session-1", "worker-1")
+
+	snapshot = g.snapshot()
+	if snapshot[0].WorkerName != "worker-1" {
+		t.Fatalf("expected worker name to be set after SessionRegistered, got %q", snapshot[0].WorkerName)
+	}
+
+	g.SessionEnded("session-1")
+
+	snapshot = g.snapshot()
+	if len(snapshot) != 0 {
+		t.Fatalf("expected no sessions after SessionEnded, got %d", len(snapshot))
+	}
+}
+
+func TestSessionGossipSessionRegisteredIgnoresUnknownSession(t *testing.T) {
+	g := newTestSessionGossip(t)
+
+	g.SessionRegistered("no-such-session", "worker-1")
+
+	if len(g.snapshot()) != 0 {
+		t.Fatalf("expected registering an unknown session to be a no-op")
+	}
+}
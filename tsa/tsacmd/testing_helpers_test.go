@@ -0,0 +1,27 @@
+package tsacmd
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testRSAKey returns a freshly generated ssh.PublicKey, suitable for tests
+// that just need some key to compare or fingerprint.
+func testRSAKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate RSA key: %s", err)
+	}
+
+	public, err := ssh.NewPublicKey(&private.PublicKey)
+	if err != nil {
+		t.Fatalf("failed to derive SSH public key: %s", err)
+	}
+
+	return public
+}